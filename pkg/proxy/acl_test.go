@@ -0,0 +1,53 @@
+// Copyright 2016 CodisLabs. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package proxy
+
+import (
+	"testing"
+
+	"github.com/CodisLabs/codis/pkg/proxy/redis"
+)
+
+func multiOf(args ...string) []*redis.Resp {
+	multi := make([]*redis.Resp, len(args))
+	for i, a := range args {
+		multi[i] = redis.NewString([]byte(a))
+	}
+	return multi
+}
+
+func TestCommandKeysMultiKey(t *testing.T) {
+	cases := []struct {
+		opstr string
+		multi []*redis.Resp
+		want  []string
+	}{
+		{"MGET", multiOf("MGET", "a", "b", "c"), []string{"a", "b", "c"}},
+		{"DEL", multiOf("DEL", "a", "b"), []string{"a", "b"}},
+		{"MSET", multiOf("MSET", "a", "1", "b", "2"), []string{"a", "b"}},
+		{"RENAME", multiOf("RENAME", "a", "b"), []string{"a", "b"}},
+		{"SMOVE", multiOf("SMOVE", "a", "b", "member"), []string{"a", "b"}},
+	}
+	for _, c := range cases {
+		got := commandKeys(c.multi, c.opstr)
+		if len(got) != len(c.want) {
+			t.Fatalf("%s: got %q, want %q", c.opstr, got, c.want)
+		}
+		for i, key := range got {
+			if string(key) != c.want[i] {
+				t.Fatalf("%s: got %q, want %q", c.opstr, got, c.want)
+			}
+		}
+	}
+}
+
+func TestAllowKeysRequiresEveryKey(t *testing.T) {
+	u := &aclUser{AllowedKeyPatterns: []string{"foo:*"}}
+	if !u.allowKeys(commandKeys(multiOf("RENAME", "foo:x", "foo:y"), "RENAME")) {
+		t.Fatalf("expected both foo:* keys to be allowed")
+	}
+	if u.allowKeys(commandKeys(multiOf("RENAME", "foo:x", "bar:secret"), "RENAME")) {
+		t.Fatalf("expected a disallowed destination key to be rejected")
+	}
+}
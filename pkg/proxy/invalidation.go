@@ -0,0 +1,173 @@
+// Copyright 2016 CodisLabs. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package proxy
+
+import (
+	"sync"
+)
+
+const (
+	maxTrackedKeysPerSession = 4096
+	trackingPushBacklog      = 64
+)
+
+// prefixTrieNode is a minimal radix-style trie node keyed by byte, used to
+// fan BCAST-mode invalidations out to every session whose PREFIX matches.
+type prefixTrieNode struct {
+	children map[byte]*prefixTrieNode
+	sessions map[int64]bool
+}
+
+func newPrefixTrieNode() *prefixTrieNode {
+	return &prefixTrieNode{children: make(map[byte]*prefixTrieNode)}
+}
+
+func (n *prefixTrieNode) insert(prefix string, id int64) {
+	cur := n
+	for i := 0; i < len(prefix); i++ {
+		c := prefix[i]
+		child, ok := cur.children[c]
+		if !ok {
+			child = newPrefixTrieNode()
+			cur.children[c] = child
+		}
+		cur = child
+	}
+	if cur.sessions == nil {
+		cur.sessions = make(map[int64]bool)
+	}
+	cur.sessions[id] = true
+}
+
+func (n *prefixTrieNode) remove(id int64) {
+	delete(n.sessions, id)
+	for _, child := range n.children {
+		child.remove(id)
+	}
+}
+
+// matches collects every session id registered on a prefix that is itself a
+// prefix of key (i.e. every BCAST subscriber whose PREFIX matches key).
+func (n *prefixTrieNode) matches(key string, out map[int64]bool) {
+	cur := n
+	for id := range cur.sessions {
+		out[id] = true
+	}
+	for i := 0; i < len(key); i++ {
+		child, ok := cur.children[key[i]]
+		if !ok {
+			return
+		}
+		cur = child
+		for id := range cur.sessions {
+			out[id] = true
+		}
+	}
+}
+
+// InvalidationBus fans write-invalidation notices out to every session that
+// has opted into CLIENT TRACKING, either because it explicitly read the key
+// (default mode) or because the key falls under one of its BCAST prefixes.
+type InvalidationBus struct {
+	mu    sync.Mutex
+	bcast *prefixTrieNode
+	exact map[string]map[int64]bool
+	push  map[int64]func(key string) bool
+	// nkeys is the live count of exact keys each session id currently has
+	// tracked, so TrackKey can enforce maxTrackedKeysPerSession as a
+	// currently-outstanding limit rather than a lifetime total: it goes back
+	// down as Publish consumes those keys or Unregister drops the session.
+	nkeys map[int64]int
+}
+
+func NewInvalidationBus() *InvalidationBus {
+	return &InvalidationBus{
+		bcast: newPrefixTrieNode(),
+		exact: make(map[string]map[int64]bool),
+		push:  make(map[int64]func(key string) bool),
+		nkeys: make(map[int64]int),
+	}
+}
+
+var invalidations = NewInvalidationBus()
+
+// Register binds a session id to the function used to push an invalidation
+// key to it (see Session.pushInvalidation).
+func (b *InvalidationBus) Register(id int64, push func(key string) bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.push[id] = push
+}
+
+func (b *InvalidationBus) Unregister(id int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.push, id)
+	delete(b.nkeys, id)
+	for key, ids := range b.exact {
+		delete(ids, id)
+		if len(ids) == 0 {
+			delete(b.exact, key)
+		}
+	}
+	b.bcast.remove(id)
+}
+
+// TrackKey records that session id is interested in key, unless id has
+// already hit maxTrackedKeysPerSession worth of keys still outstanding;
+// reports whether the key was recorded.
+func (b *InvalidationBus) TrackKey(key string, id int64) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	ids, ok := b.exact[key]
+	if ok && ids[id] {
+		return true
+	}
+	if b.nkeys[id] >= maxTrackedKeysPerSession {
+		return false
+	}
+	if !ok {
+		ids = make(map[int64]bool)
+		b.exact[key] = ids
+	}
+	ids[id] = true
+	b.nkeys[id]++
+	return true
+}
+
+func (b *InvalidationBus) TrackPrefix(prefix string, id int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.bcast.insert(prefix, id)
+}
+
+// Publish notifies every interested session that key was written, dropping
+// any session whose push function reports backpressure.
+func (b *InvalidationBus) Publish(key string) {
+	b.mu.Lock()
+	targets := make(map[int64]bool)
+	if ids, ok := b.exact[key]; ok {
+		for id := range ids {
+			targets[id] = true
+			if b.nkeys[id] > 0 {
+				b.nkeys[id]--
+			}
+		}
+		delete(b.exact, key)
+	}
+	b.bcast.matches(key, targets)
+	pushers := make(map[int64]func(key string) bool, len(targets))
+	for id := range targets {
+		if f, ok := b.push[id]; ok {
+			pushers[id] = f
+		}
+	}
+	b.mu.Unlock()
+
+	for id, push := range pushers {
+		if !push(key) {
+			b.Unregister(id)
+		}
+	}
+}
@@ -0,0 +1,57 @@
+// Copyright 2016 CodisLabs. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package proxy
+
+import (
+	"time"
+
+	"github.com/CodisLabs/codis/pkg/models"
+	"github.com/CodisLabs/codis/pkg/proxy/redis"
+)
+
+// KeyToSlot hashes a key to its slot number using the same hash as dispatch,
+// so callers can pin a connection to a slot before the first command of a
+// transaction is actually dispatched.
+func (s *Router) KeyToSlot(key []byte) int {
+	return int(Hash(key) % uint32(models.MaxSlotNum))
+}
+
+// BackendAddrs returns the distinct backend group addresses currently known
+// to the router, in no particular order. Used to fan PUBLISH and PUBSUB
+// queries out to every group, and to open one dedicated pub/sub connection
+// per group.
+func (s *Router) BackendAddrs() []string {
+	seen := make(map[string]bool)
+	var addrs []string
+	for _, m := range s.GetSlots() {
+		if m == nil || m.BackendAddr == "" || seen[m.BackendAddr] {
+			continue
+		}
+		seen[m.BackendAddr] = true
+		addrs = append(addrs, m.BackendAddr)
+	}
+	return addrs
+}
+
+// dispatchTxn checks out a backend connection for the given slot and pins it
+// for the lifetime of a MULTI/EXEC transaction. The caller is responsible for
+// closing the connection (which returns it to the pool) once the transaction
+// completes or is discarded.
+func (s *Router) dispatchTxn(slot int) (*redis.Conn, error) {
+	bc := s.pool.GetBackendConn(s.GetSlot(slot))
+	if bc == nil {
+		return nil, ErrRouterNotOnline
+	}
+	return bc, nil
+}
+
+// dispatchGroupConn dials a dedicated, long-lived connection directly to the
+// given backend group address, bypassing slot lookup and, unlike dispatchTxn,
+// the shared backend connection pool too. A pub/sub subscriber holds one of
+// these per group for as long as it stays subscribed; sourcing that from the
+// same pool ordinary dispatch and MULTI/EXEC share would let a handful of
+// long-lived subscribers starve it for every other session.
+func (s *Router) dispatchGroupConn(addr string) (*redis.Conn, error) {
+	return redis.DialTimeout(addr, time.Second*5)
+}
@@ -0,0 +1,157 @@
+// Copyright 2016 CodisLabs. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package proxy
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/CodisLabs/codis/pkg/proxy/redis"
+	"github.com/CodisLabs/codis/pkg/utils/log"
+)
+
+// sentinelMasters records, per backend group address as Codis currently
+// knows it, the master address Sentinel most recently reported. This lets
+// handleRequestSlotsMapping surface both Codis's own view and Sentinel's
+// view of the same group.
+var sentinelMasters = struct {
+	sync.RWMutex
+	m map[string]string
+}{m: make(map[string]string)}
+
+// SentinelObservedMaster returns the master address Sentinel last reported
+// for the backend group Codis knows as groupAddr, if a SentinelWatcher is
+// running and has seen an event for it.
+func SentinelObservedMaster(groupAddr string) (string, bool) {
+	sentinelMasters.RLock()
+	defer sentinelMasters.RUnlock()
+	addr, ok := sentinelMasters.m[groupAddr]
+	return addr, ok
+}
+
+func setSentinelObservedMaster(groupAddr, master string) {
+	sentinelMasters.Lock()
+	defer sentinelMasters.Unlock()
+	sentinelMasters.m[groupAddr] = master
+}
+
+// SentinelWatcher subscribes to +switch-master/+sdown/+odown on a set of
+// Sentinel addresses and drives Router.OnSentinelEvent as they arrive, so a
+// master failover is reflected in the slot table without waiting for the
+// dashboard to reconcile.
+type SentinelWatcher struct {
+	router *Router
+	addrs  []string
+	quit   chan struct{}
+}
+
+func NewSentinelWatcher(router *Router, addrs []string) *SentinelWatcher {
+	return &SentinelWatcher{router: router, addrs: addrs, quit: make(chan struct{})}
+}
+
+func (w *SentinelWatcher) Start() {
+	for _, addr := range w.addrs {
+		go w.watch(addr)
+	}
+}
+
+func (w *SentinelWatcher) Close() {
+	close(w.quit)
+}
+
+func (w *SentinelWatcher) watch(addr string) {
+	for {
+		select {
+		case <-w.quit:
+			return
+		default:
+		}
+		if err := w.subscribeOnce(addr); err != nil {
+			log.Warnf("sentinel watcher: %s: %s, retrying", addr, err)
+		}
+		select {
+		case <-w.quit:
+			return
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+func (w *SentinelWatcher) subscribeOnce(addr string) error {
+	conn, err := redis.DialTimeout(addr, time.Second*5)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	sub := redis.NewMultiBulk([]*redis.Resp{
+		redis.NewString([]byte("SUBSCRIBE")),
+		redis.NewString([]byte("+switch-master")),
+		redis.NewString([]byte("+sdown")),
+		redis.NewString([]byte("+odown")),
+	})
+	if err := conn.Encode(sub, true); err != nil {
+		return err
+	}
+	for {
+		resp, err := conn.Decode()
+		if err != nil {
+			return err
+		}
+		if !resp.IsArray() || len(resp.Array) < 3 {
+			continue
+		}
+		if string(resp.Array[0].Value) != "message" {
+			continue
+		}
+		channel := string(resp.Array[1].Value)
+		payload := string(resp.Array[2].Value)
+		if err := w.router.OnSentinelEvent(channel, payload); err != nil {
+			log.Warnf("sentinel watcher: bad %s event %q: %s", channel, payload, err)
+		}
+	}
+}
+
+// OnSentinelEvent applies a Sentinel pub/sub notification to the router's
+// slot table. +switch-master moves every slot whose master matches the old
+// address onto the new one; +sdown/+odown are logged only, Sentinel already
+// handles the actual failover decision.
+func (s *Router) OnSentinelEvent(channel, payload string) error {
+	switch channel {
+	case "+switch-master":
+		fields := strings.Fields(payload)
+		if len(fields) < 5 {
+			return fmt.Errorf("malformed +switch-master payload: %q", payload)
+		}
+		oldAddr := fmt.Sprintf("%s:%s", fields[1], fields[2])
+		newAddr := fmt.Sprintf("%s:%s", fields[3], fields[4])
+		return s.migrateSentinelMaster(oldAddr, newAddr)
+	case "+sdown", "+odown":
+		log.Warnf("sentinel reported %s: %s", channel, payload)
+		return nil
+	default:
+		return nil
+	}
+}
+
+func (s *Router) migrateSentinelMaster(oldAddr, newAddr string) error {
+	for _, m := range s.GetSlots() {
+		if m == nil || m.BackendAddr != oldAddr {
+			continue
+		}
+		next := *m
+		next.BackendAddr = newAddr
+		if err := s.FillSlot(&next); err != nil {
+			return err
+		}
+	}
+	// handleRequestSlotsMapping looks this up keyed by each slot's current
+	// (post-FillSlot) BackendAddr, which is newAddr from here on — keying by
+	// oldAddr would mean the entry is never read again once FillSlot above
+	// has already moved the slot off of it.
+	setSentinelObservedMaster(newAddr, newAddr)
+	return nil
+}
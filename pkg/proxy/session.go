@@ -7,6 +7,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -25,9 +26,11 @@ type Session struct {
 	CreateUnix int64
 	LastOpUnix int64
 
-	auth string
-	quit bool
-	exit sync.Once
+	users    *UserDB
+	username string
+	user     *aclUser
+	quit     bool
+	exit     sync.Once
 
 	stats struct {
 		opmap map[string]*opStats
@@ -43,6 +46,15 @@ type Session struct {
 	authorized bool
 
 	alloc RequestAlloc
+
+	txn    txnState
+	pubsub pubsubState
+
+	Id       int64
+	resp3    bool
+	tracking trackingState
+	pushCh   chan *redis.Resp
+	writeMu  sync.Mutex
 }
 
 func (s *Session) String() string {
@@ -59,18 +71,26 @@ func (s *Session) String() string {
 	return string(b)
 }
 
-func NewSession(conn *redis.Conn, auth string) *Session {
+func NewSession(conn *redis.Conn, users *UserDB) *Session {
 	s := &Session{
-		Conn: conn, auth: auth,
+		Conn: conn, users: users,
 		CreateUnix: time.Now().Unix(),
+		Id:         nextSessionId(),
+		pushCh:     make(chan *redis.Resp, trackingPushBacklog),
 	}
 	s.stats.opmap = make(map[string]*opStats, 16)
+	sessionsByID.Store(s.Id, s)
+	go s.loopPush()
 	log.Infof("session [%p] create: %s", s, s)
 	return s
 }
 
 func (s *Session) CloseWithError(err error, half bool) {
 	s.exit.Do(func() {
+		s.exitPubSub()
+		s.stopTracking()
+		sessionsByID.Delete(s.Id)
+		close(s.pushCh)
 		if err != nil {
 			log.Infof("session [%p] closed: %s, error: %s", s, s, err)
 		} else {
@@ -92,11 +112,19 @@ var (
 
 var RespOK = redis.NewString([]byte("OK"))
 
+// RespNoReply is a sentinel assigned to Request.Resp by handlers whose reply
+// is (or will be) written to the client out-of-band — e.g. pub/sub acks
+// forwarded straight off a backend connection. handleResponse/loopWriter
+// recognize it by pointer identity and skip writing anything for it.
+var RespNoReply = new(redis.Resp)
+
 func (s *Session) Start(d *Router, config *Config) {
 	s.start.Do(func() {
 		if int(incrSessions()) > config.ProxyMaxClients {
 			go func() {
+				s.writeMu.Lock()
 				s.Conn.Encode(redis.NewErrorf("ERR max number of clients reached"), true)
+				s.writeMu.Unlock()
 				s.CloseWithError(ErrTooManySessions, false)
 			}()
 			decrSessions()
@@ -105,7 +133,9 @@ func (s *Session) Start(d *Router, config *Config) {
 
 		if !d.isOnline() {
 			go func() {
+				s.writeMu.Lock()
 				s.Conn.Encode(redis.NewErrorf("ERR router is not online"), true)
+				s.writeMu.Unlock()
 				s.CloseWithError(ErrRouterNotOnline, false)
 			}()
 			decrSessions()
@@ -174,10 +204,19 @@ func (s *Session) loopWriter(tasks <-chan *Request) (err error) {
 		resp, err := s.handleResponse(r)
 		if err != nil {
 			resp = redis.NewErrorf("ERR handle response, %s", err)
+			s.writeMu.Lock()
 			s.Conn.Encode(resp, true)
+			s.writeMu.Unlock()
 			return s.incrOpFails(err)
 		}
-		if err := s.Conn.Encode(resp, false); err != nil {
+		if resp == RespNoReply {
+			r.Release()
+			continue
+		}
+		s.writeMu.Lock()
+		err = s.Conn.Encode(resp, false)
+		s.writeMu.Unlock()
+		if err != nil {
 			return s.incrOpFails(err)
 		} else {
 			r.Release()
@@ -185,7 +224,10 @@ func (s *Session) loopWriter(tasks <-chan *Request) (err error) {
 		if len(tasks) != 0 {
 			continue
 		}
-		if err := s.Conn.Flush(); err != nil {
+		s.writeMu.Lock()
+		err = s.Conn.Flush()
+		s.writeMu.Unlock()
+		if err != nil {
 			return s.incrOpFails(err)
 		}
 		s.flushOpStats(false)
@@ -206,12 +248,35 @@ func (s *Session) handleResponse(r *Request) (*redis.Resp, error) {
 	switch resp := r.Resp; {
 	case resp == nil:
 		return nil, ErrRespIsRequired
+	case resp == RespNoReply:
+		return resp, nil
 	default:
 		s.incrOpStats(r)
+		s.trackResponse(r)
 		return resp, nil
 	}
 }
 
+// trackResponse feeds CLIENT TRACKING bookkeeping once a request has
+// completed successfully: writes invalidate every key the command touched
+// (MSET/DEL and friends can carry several), reads (on a tracking session)
+// add the single key fetched to its interest set.
+func (s *Session) trackResponse(r *Request) {
+	if isWriteCommand(r.OpStr) {
+		for _, key := range commandKeys(r.Multi, r.OpStr) {
+			if len(key) != 0 {
+				invalidations.Publish(string(key))
+			}
+		}
+		return
+	}
+	if s.tracking.on {
+		if key := getHashKey(r.Multi, r.OpStr); len(key) != 0 {
+			s.trackRead(key)
+		}
+	}
+}
+
 func (s *Session) handleRequest(r *Request, d *Router) error {
 	opstr, flag, err := getOpInfo(r.Multi)
 	if err != nil {
@@ -233,14 +298,51 @@ func (s *Session) handleRequest(r *Request, d *Router) error {
 	}
 
 	if !s.authorized {
-		if s.auth != "" {
+		if s.users != nil {
 			r.Resp = redis.NewErrorf("NOAUTH Authentication required")
 			return nil
 		}
 		s.authorized = true
 	}
 
+	if s.user != nil {
+		if !s.user.allowCommand(opstr) {
+			r.Resp = redis.NewErrorf("NOPERM User %s has no permissions to run the '%s' command", s.username, strings.ToLower(opstr))
+			return nil
+		}
+		if !s.user.allowKeys(commandKeys(r.Multi, opstr)) {
+			r.Resp = redis.NewErrorf("NOPERM No permissions to access a key used in this command")
+			return nil
+		}
+	}
+
+	if s.txn.active {
+		switch opstr {
+		case "MULTI":
+			r.Resp = redis.NewErrorf("ERR MULTI calls can not be nested")
+			return nil
+		case "EXEC":
+			return s.handleTxnExec(r, d)
+		case "DISCARD":
+			return s.handleTxnDiscard(r)
+		default:
+			return s.handleTxnQueue(r, d)
+		}
+	}
+
 	switch opstr {
+	case "MULTI":
+		return s.handleTxnMulti(r)
+	case "WATCH":
+		return s.handleTxnWatch(r, d)
+	case "UNWATCH":
+		return s.handleTxnUnwatch(r)
+	case "EXEC":
+		r.Resp = redis.NewErrorf("ERR EXEC without MULTI")
+		return nil
+	case "DISCARD":
+		r.Resp = redis.NewErrorf("ERR DISCARD without MULTI")
+		return nil
 	case "SELECT":
 		return s.handleSelect(r)
 	case "PING":
@@ -253,13 +355,45 @@ func (s *Session) handleRequest(r *Request, d *Router) error {
 		return s.handleRequestMSet(r, d)
 	case "DEL":
 		return s.handleRequestMDel(r, d)
+	case "EXISTS":
+		return s.handleRequestMExists(r, d)
+	case "UNLINK":
+		return s.handleRequestMUnlink(r, d)
+	case "TOUCH":
+		return s.handleRequestMTouch(r, d)
+	case "PFCOUNT":
+		return s.handleRequestPFCount(r, d)
 	case "SLOTSINFO":
 		return s.handleRequestSlotsInfo(r, d)
 	case "SLOTSSCAN":
 		return s.handleRequestSlotsScan(r, d)
 	case "SLOTSMAPPING":
 		return s.handleRequestSlotsMapping(r, d)
+	case "CLUSTER":
+		return s.handleRequestCluster(r, d)
+	case "READONLY":
+		return s.handleRequestReadOnly(r)
+	case "READWRITE":
+		return s.handleRequestReadWrite(r)
+	case "SUBSCRIBE", "PSUBSCRIBE":
+		return s.handleRequestSubscribe(r, d)
+	case "UNSUBSCRIBE", "PUNSUBSCRIBE":
+		return s.handleRequestUnsubscribe(r, d)
+	case "PUBLISH":
+		return s.handleRequestPublish(r, d)
+	case "PUBSUB":
+		return s.handleRequestPubSub(r, d)
+	case "ACL":
+		return s.handleRequestAcl(r)
+	case "CLIENT":
+		return s.handleRequestClient(r, d)
+	case "HELLO":
+		return s.handleRequestHello(r)
 	default:
+		if resp := s.redirectForMigration(r, d); resp != nil {
+			r.Resp = resp
+			return nil
+		}
 		return d.dispatch(r)
 	}
 }
@@ -271,19 +405,83 @@ func (s *Session) handleQuit(r *Request) error {
 }
 
 func (s *Session) handleAuth(r *Request) error {
-	if len(r.Multi) != 2 {
+	var username, password string
+	switch len(r.Multi) - 1 {
+	case 1:
+		username, password = "default", string(r.Multi[1].Value)
+	case 2:
+		username, password = string(r.Multi[1].Value), string(r.Multi[2].Value)
+	default:
 		r.Resp = redis.NewErrorf("ERR wrong number of arguments for 'AUTH' command")
 		return nil
 	}
-	switch {
-	case s.auth == "":
+	if s.users == nil {
 		r.Resp = redis.NewErrorf("ERR Client sent AUTH, but no password is set")
-	case s.auth != string(r.Multi[1].Value):
+		return nil
+	}
+	u, ok := s.users.Get(username)
+	if !ok || u.Password != password {
 		s.authorized = false
-		r.Resp = redis.NewErrorf("ERR invalid password")
+		r.Resp = redis.NewErrorf("WRONGPASS invalid username-password pair or user is disabled")
+		return nil
+	}
+	s.authorized = true
+	s.username = username
+	s.user = u
+	r.Resp = RespOK
+	return nil
+}
+
+func (s *Session) handleRequestAcl(r *Request) error {
+	if len(r.Multi) < 2 {
+		r.Resp = redis.NewErrorf("ERR wrong number of arguments for 'ACL' command")
+		return nil
+	}
+	switch sub := strings.ToUpper(string(r.Multi[1].Value)); sub {
+	case "WHOAMI":
+		name := s.username
+		if name == "" {
+			name = "default"
+		}
+		r.Resp = redis.NewString([]byte(name))
+	case "LIST":
+		var array []*redis.Resp
+		if s.users != nil {
+			for _, name := range s.users.Names() {
+				array = append(array, redis.NewString([]byte(fmt.Sprintf("user %s", name))))
+			}
+		}
+		r.Resp = redis.NewArray(array)
+	case "GETUSER":
+		if len(r.Multi) != 3 {
+			r.Resp = redis.NewErrorf("ERR wrong number of arguments for 'ACL|GETUSER' command")
+			return nil
+		}
+		if s.users == nil {
+			r.Resp = redis.NewArray(nil)
+			return nil
+		}
+		u, ok := s.users.Get(string(r.Multi[2].Value))
+		if !ok {
+			r.Resp = redis.NewArray(nil)
+			return nil
+		}
+		var commands []*redis.Resp
+		for _, c := range u.AllowedCommands {
+			commands = append(commands, redis.NewString([]byte(c)))
+		}
+		var keys []*redis.Resp
+		for _, k := range u.AllowedKeyPatterns {
+			keys = append(keys, redis.NewString([]byte(k)))
+		}
+		r.Resp = redis.NewArray([]*redis.Resp{
+			redis.NewString([]byte("commands")),
+			redis.NewArray(commands),
+			redis.NewString([]byte("keys")),
+			redis.NewArray(keys),
+		})
 	default:
-		s.authorized = true
-		r.Resp = RespOK
+		r.Resp = redis.NewErrorf("ERR unknown ACL subcommand '%s'", sub)
 	}
 	return nil
 }
@@ -523,11 +721,16 @@ func (s *Session) handleRequestSlotsMapping(r *Request, d *Router) error {
 			}
 			replicaGroups = append(replicaGroups, redis.NewArray(group))
 		}
+		var sentinelAddr string
+		if addr, ok := SentinelObservedMaster(m.BackendAddr); ok {
+			sentinelAddr = addr
+		}
 		return redis.NewArray([]*redis.Resp{
 			redis.NewString([]byte(strconv.Itoa(m.Id))),
 			redis.NewString([]byte(m.BackendAddr)),
 			redis.NewString([]byte(m.MigrateFrom)),
 			redis.NewArray(replicaGroups),
+			redis.NewString([]byte(sentinelAddr)),
 		})
 	}
 	if nblks == 0 {
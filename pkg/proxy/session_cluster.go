@@ -0,0 +1,291 @@
+// Copyright 2016 CodisLabs. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package proxy
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/CodisLabs/codis/pkg/models"
+	"github.com/CodisLabs/codis/pkg/proxy/redis"
+)
+
+// clusterNodeId derives a stable, Redis-Cluster-looking 40 char hex id for a
+// backend address. Codis groups don't carry a real node id, so we fabricate
+// one deterministically from the address instead of persisting anything.
+func clusterNodeId(addr string) string {
+	sum := sha1.Sum([]byte(addr))
+	return hex.EncodeToString(sum[:])
+}
+
+// clusterNodeAddr splits "ip:port" and returns the cluster-bus port (port +
+// 10000), following the convention used by real Redis Cluster nodes.
+func clusterNodeAddr(addr string) (ip string, port string, cport string) {
+	i := strings.LastIndex(addr, ":")
+	if i < 0 {
+		return addr, "0", "10000"
+	}
+	ip, port = addr[:i], addr[i+1:]
+	if n, err := strconv.Atoi(port); err == nil {
+		cport = strconv.Itoa(n + 10000)
+	} else {
+		cport = "10000"
+	}
+	return ip, port, cport
+}
+
+func (s *Session) handleRequestClusterSlots(r *Request, d *Router) error {
+	type slotRange struct {
+		start, end int
+		master     string
+		replicas   []string
+	}
+	var ranges []*slotRange
+	for i, m := range d.GetSlots() {
+		var master string
+		var replicas []string
+		if m != nil {
+			master = m.BackendAddr
+			for _, g := range m.ReplicaGroups {
+				replicas = append(replicas, g...)
+			}
+		}
+		if master == "" {
+			continue
+		}
+		if n := len(ranges); n != 0 {
+			last := ranges[n-1]
+			if last.end == i-1 && last.master == master && sameAddrs(last.replicas, replicas) {
+				last.end = i
+				continue
+			}
+		}
+		ranges = append(ranges, &slotRange{start: i, end: i, master: master, replicas: replicas})
+	}
+	var array []*redis.Resp
+	for _, rg := range ranges {
+		entry := []*redis.Resp{
+			redis.NewInt(strconv.AppendInt(nil, int64(rg.start), 10)),
+			redis.NewInt(strconv.AppendInt(nil, int64(rg.end), 10)),
+		}
+		entry = append(entry, clusterSlotsNode(rg.master))
+		for _, addr := range rg.replicas {
+			entry = append(entry, clusterSlotsNode(addr))
+		}
+		array = append(array, redis.NewArray(entry))
+	}
+	r.Resp = redis.NewArray(array)
+	return nil
+}
+
+func clusterSlotsNode(addr string) *redis.Resp {
+	ip, port, _ := clusterNodeAddr(addr)
+	return redis.NewArray([]*redis.Resp{
+		redis.NewString([]byte(ip)),
+		redis.NewInt([]byte(port)),
+		redis.NewString([]byte(clusterNodeId(addr))),
+		redis.NewArray(nil),
+	})
+}
+
+func sameAddrs(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *Session) handleRequestClusterNodes(r *Request, d *Router) error {
+	var lines []string
+	for _, sh := range groupSlotsByMaster(d) {
+		lines = append(lines, clusterNodeLine(sh.master, "master", "-", coalesceSlots(sh.slots)))
+		for _, addr := range sh.replicas {
+			lines = append(lines, clusterNodeLine(addr, "slave", clusterNodeId(sh.master), nil))
+		}
+	}
+	r.Resp = redis.NewString([]byte(strings.Join(lines, "\n") + "\n"))
+	return nil
+}
+
+func clusterNodeLine(addr, role, master string, ranges [][2]int) string {
+	ip, port, cport := clusterNodeAddr(addr)
+	flags := "myself,master"
+	if role == "slave" {
+		flags = "slave"
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s %s:%s@%s %s %s 0 0 0 connected", clusterNodeId(addr), ip, port, cport, flags, master)
+	for _, rg := range ranges {
+		if rg[0] == rg[1] {
+			fmt.Fprintf(&b, " %d", rg[0])
+		} else {
+			fmt.Fprintf(&b, " %d-%d", rg[0], rg[1])
+		}
+	}
+	return b.String()
+}
+
+// shardGroup is the set of slots owned by one master, together with its
+// replicas. Shared by CLUSTER NODES and CLUSTER SHARDS so both emit exactly
+// one entry per node instead of one per slot.
+type shardGroup struct {
+	slots    []int
+	master   string
+	replicas []string
+}
+
+// groupSlotsByMaster walks the slot table once and coalesces it into one
+// shardGroup per master address, in first-seen order.
+func groupSlotsByMaster(d *Router) []*shardGroup {
+	byMaster := make(map[string]*shardGroup)
+	var order []string
+	for i, m := range d.GetSlots() {
+		if m == nil || m.BackendAddr == "" {
+			continue
+		}
+		sh, ok := byMaster[m.BackendAddr]
+		if !ok {
+			sh = &shardGroup{master: m.BackendAddr}
+			for _, g := range m.ReplicaGroups {
+				sh.replicas = append(sh.replicas, g...)
+			}
+			byMaster[m.BackendAddr] = sh
+			order = append(order, m.BackendAddr)
+		}
+		sh.slots = append(sh.slots, i)
+	}
+	groups := make([]*shardGroup, len(order))
+	for i, addr := range order {
+		groups[i] = byMaster[addr]
+	}
+	return groups
+}
+
+func (s *Session) handleRequestClusterShards(r *Request, d *Router) error {
+	var array []*redis.Resp
+	for _, sh := range groupSlotsByMaster(d) {
+		var slotsResp []*redis.Resp
+		for _, rg := range coalesceSlots(sh.slots) {
+			slotsResp = append(slotsResp,
+				redis.NewInt(strconv.AppendInt(nil, int64(rg[0]), 10)),
+				redis.NewInt(strconv.AppendInt(nil, int64(rg[1]), 10)),
+			)
+		}
+		var nodes []*redis.Resp
+		nodes = append(nodes, clusterShardNode(sh.master, "master"))
+		for _, addr := range sh.replicas {
+			nodes = append(nodes, clusterShardNode(addr, "replica"))
+		}
+		array = append(array, redis.NewArray([]*redis.Resp{
+			redis.NewString([]byte("slots")),
+			redis.NewArray(slotsResp),
+			redis.NewString([]byte("nodes")),
+			redis.NewArray(nodes),
+		}))
+	}
+	r.Resp = redis.NewArray(array)
+	return nil
+}
+
+func clusterShardNode(addr, role string) *redis.Resp {
+	ip, port, _ := clusterNodeAddr(addr)
+	return redis.NewArray([]*redis.Resp{
+		redis.NewString([]byte("id")),
+		redis.NewString([]byte(clusterNodeId(addr))),
+		redis.NewString([]byte("ip")),
+		redis.NewString([]byte(ip)),
+		redis.NewString([]byte("port")),
+		redis.NewInt([]byte(port)),
+		redis.NewString([]byte("role")),
+		redis.NewString([]byte(role)),
+	})
+}
+
+// coalesceSlots groups a sorted slice of slot ids into contiguous [start,end]
+// ranges.
+func coalesceSlots(slots []int) [][2]int {
+	var ranges [][2]int
+	for _, i := range slots {
+		if n := len(ranges); n != 0 && ranges[n-1][1] == i-1 {
+			ranges[n-1][1] = i
+			continue
+		}
+		ranges = append(ranges, [2]int{i, i})
+	}
+	return ranges
+}
+
+func (s *Session) handleRequestClusterInfo(r *Request, d *Router) error {
+	var known int
+	for _, m := range d.GetSlots() {
+		if m != nil && m.BackendAddr != "" {
+			known++
+		}
+	}
+	state := "ok"
+	if known != models.MaxSlotNum {
+		state = "fail"
+	}
+	// cluster_known_nodes/cluster_size describe the node topology, not the
+	// slot table: "known" above counts assigned slots (up to MaxSlotNum),
+	// which would wildly overstate node counts for any real deployment, so
+	// derive the real per-master/replica counts from groupSlotsByMaster
+	// instead (the same grouping CLUSTER NODES/SHARDS already use).
+	groups := groupSlotsByMaster(d)
+	var nodes int
+	for _, sh := range groups {
+		nodes += 1 + len(sh.replicas)
+	}
+	info := fmt.Sprintf(""+
+		"cluster_enabled:1\r\n"+
+		"cluster_state:%s\r\n"+
+		"cluster_slots_assigned:%d\r\n"+
+		"cluster_slots_ok:%d\r\n"+
+		"cluster_slots_pfail:0\r\n"+
+		"cluster_slots_fail:0\r\n"+
+		"cluster_known_nodes:%d\r\n"+
+		"cluster_size:%d\r\n"+
+		"cluster_current_epoch:0\r\n"+
+		"cluster_my_epoch:0\r\n", state, known, known, nodes, len(groups))
+	r.Resp = redis.NewString([]byte(info))
+	return nil
+}
+
+func (s *Session) handleRequestReadOnly(r *Request) error {
+	r.Resp = RespOK
+	return nil
+}
+
+func (s *Session) handleRequestReadWrite(r *Request) error {
+	r.Resp = RespOK
+	return nil
+}
+
+func (s *Session) handleRequestCluster(r *Request, d *Router) error {
+	if len(r.Multi) < 2 {
+		r.Resp = redis.NewErrorf("ERR wrong number of arguments for 'CLUSTER' command")
+		return nil
+	}
+	switch sub := strings.ToUpper(string(r.Multi[1].Value)); sub {
+	case "SLOTS":
+		return s.handleRequestClusterSlots(r, d)
+	case "NODES":
+		return s.handleRequestClusterNodes(r, d)
+	case "SHARDS":
+		return s.handleRequestClusterShards(r, d)
+	case "INFO":
+		return s.handleRequestClusterInfo(r, d)
+	default:
+		r.Resp = redis.NewErrorf("ERR unknown CLUSTER subcommand '%s'", sub)
+		return nil
+	}
+}
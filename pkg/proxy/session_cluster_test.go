@@ -0,0 +1,27 @@
+// Copyright 2016 CodisLabs. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package proxy
+
+import "testing"
+
+func TestCoalesceSlots(t *testing.T) {
+	ranges := coalesceSlots([]int{0, 1, 2, 5, 6, 10})
+	want := [][2]int{{0, 2}, {5, 6}, {10, 10}}
+	if len(ranges) != len(want) {
+		t.Fatalf("got %v, want %v", ranges, want)
+	}
+	for i, rg := range ranges {
+		if rg != want[i] {
+			t.Fatalf("got %v, want %v", ranges, want)
+		}
+	}
+}
+
+func TestClusterNodeLineRangeFormat(t *testing.T) {
+	line := clusterNodeLine("127.0.0.1:6379", "master", "-", [][2]int{{0, 1}, {5, 5}})
+	const wantSuffix = "connected 0-1 5"
+	if len(line) < len(wantSuffix) || line[len(line)-len(wantSuffix):] != wantSuffix {
+		t.Fatalf("got %q, want suffix %q", line, wantSuffix)
+	}
+}
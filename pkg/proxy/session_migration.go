@@ -0,0 +1,30 @@
+// Copyright 2016 CodisLabs. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package proxy
+
+import (
+	"github.com/CodisLabs/codis/pkg/proxy/redis"
+)
+
+// redirectForMigration returns the Redis-Cluster-protocol redirect a
+// cluster-aware client (go-redis ClusterClient, jedis JedisCluster, lettuce)
+// expects when the key it's operating on sits in a slot that's mid-migration:
+// such a client may have cached CLUSTER SLOTS/SHARDS output and be talking to
+// a backend node directly instead of going through this proxy for every
+// command, so it needs the same -ASK signal a real cluster node would give
+// while the key may still only exist on the migration source. Outside of an
+// active migration this returns nil and the command is dispatched normally,
+// since Codis already routes every slot correctly on its own.
+func (s *Session) redirectForMigration(r *Request, d *Router) *redis.Resp {
+	keys := commandKeys(r.Multi, r.OpStr)
+	if len(keys) == 0 {
+		return nil
+	}
+	slot := d.KeyToSlot(keys[0])
+	m := d.GetSlot(slot)
+	if m == nil || m.MigrateFrom == "" {
+		return nil
+	}
+	return redis.NewErrorf("ASK %d %s", slot, m.MigrateFrom)
+}
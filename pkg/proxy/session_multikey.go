@@ -0,0 +1,204 @@
+// Copyright 2016 CodisLabs. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package proxy
+
+import (
+	"fmt"
+	"strconv"
+	"sync/atomic"
+
+	"github.com/CodisLabs/codis/pkg/proxy/redis"
+	"github.com/CodisLabs/codis/pkg/utils/log"
+)
+
+var pfcountTmpGen int64
+
+// nextPFCountTmpID hands out a fresh id for handleRequestPFCount's temporary
+// key names. Naming them from the pooled *Request's address instead would
+// risk reusing a name while a prior call's cleanup is still in flight once
+// the Request is recycled, so this uses its own monotonic counter.
+func nextPFCountTmpID() int64 {
+	return atomic.AddInt64(&pfcountTmpGen, 1)
+}
+
+// handleRequestMultiKeyCount implements the EXISTS/UNLINK/TOUCH family: each
+// of these takes a variable list of keys and replies with the sum of the
+// per-key integer replies, exactly like handleRequestMDel already does for
+// DEL.
+func (s *Session) handleRequestMultiKeyCount(r *Request, d *Router, opstr string) error {
+	var nkeys = len(r.Multi) - 1
+	switch {
+	case nkeys == 0:
+		r.Resp = redis.NewErrorf("ERR wrong number of arguments for '%s' command", opstr)
+		return nil
+	case nkeys == 1:
+		return d.dispatch(r)
+	}
+	var sub = make([]*Request, nkeys)
+	for i := range sub {
+		sub[i] = s.alloc.SubRequest(r)
+		sub[i].Multi = []*redis.Resp{
+			r.Multi[0],
+			r.Multi[i+1],
+		}
+		if err := d.dispatch(sub[i]); err != nil {
+			return err
+		}
+	}
+	r.Coalesce = func() error {
+		var n int64
+		for _, x := range sub {
+			if err := x.Err; err != nil {
+				return err
+			}
+			switch resp := x.Resp; {
+			case resp == nil:
+				return ErrRespIsRequired
+			case resp.IsInt():
+				v, err := redis.Btoi64(resp.Value)
+				if err != nil {
+					return err
+				}
+				n += v
+			default:
+				return fmt.Errorf("bad %s resp: %s value.len = %d", opstr, resp.Type, len(resp.Value))
+			}
+		}
+		r.Resp = redis.NewInt(strconv.AppendInt(nil, n, 10))
+		return nil
+	}
+	return nil
+}
+
+func (s *Session) handleRequestMExists(r *Request, d *Router) error {
+	return s.handleRequestMultiKeyCount(r, d, "EXISTS")
+}
+
+func (s *Session) handleRequestMUnlink(r *Request, d *Router) error {
+	return s.handleRequestMultiKeyCount(r, d, "UNLINK")
+}
+
+func (s *Session) handleRequestMTouch(r *Request, d *Router) error {
+	return s.handleRequestMultiKeyCount(r, d, "TOUCH")
+}
+
+// handleRequestPFCount unions HyperLogLogs that may live on different
+// slots. PFMERGE only works when all its operands sit on the same backend,
+// so each source key is fetched with DUMP, RESTOREd under a temporary name
+// on a single chosen shard (the first key's slot), merged there with
+// PFMERGE, and the merged estimate is read back with PFCOUNT; the temporary
+// keys are cleaned up with UNLINK once done.
+func (s *Session) handleRequestPFCount(r *Request, d *Router) error {
+	var nkeys = len(r.Multi) - 1
+	switch {
+	case nkeys == 0:
+		r.Resp = redis.NewErrorf("ERR wrong number of arguments for 'PFCOUNT' command")
+		return nil
+	case nkeys == 1:
+		return d.dispatch(r)
+	}
+
+	var dumps = make([]*Request, nkeys)
+	for i := range dumps {
+		dumps[i] = s.alloc.SubRequest(r)
+		dumps[i].Multi = []*redis.Resp{
+			redis.NewString([]byte("DUMP")),
+			r.Multi[i+1],
+		}
+		if err := d.dispatch(dumps[i]); err != nil {
+			return err
+		}
+	}
+
+	// Every temporary key below carries the same {hashtag}, derived from the
+	// first operand, so they all land on the shard it's already pinned to.
+	tag := string(r.Multi[1].Value)
+	merged := fmt.Sprintf("{%s}codis:pfcount:tmp:%d", tag, nextPFCountTmpID())
+
+	r.Coalesce = func() error {
+		var members []string
+		// Runs on every exit of this closure, not just the success path, so
+		// a DUMP/RESTORE/PFMERGE/PFCOUNT error partway through still cleans
+		// up whatever temp keys earlier source keys already wrote; it waits
+		// for UNLINK to actually finish instead of firing it and moving on,
+		// so a retried PFCOUNT (e.g. after a pooled *Request is recycled)
+		// can't collide with a cleanup still in flight.
+		defer func() {
+			cleanupMulti := []*redis.Resp{redis.NewString([]byte("UNLINK")), redis.NewString([]byte(merged))}
+			for _, member := range members {
+				cleanupMulti = append(cleanupMulti, redis.NewString([]byte(member)))
+			}
+			cleanup := s.alloc.SubRequest(r)
+			cleanup.Multi = cleanupMulti
+			if err := d.dispatch(cleanup); err != nil {
+				log.Warnf("pfcount cleanup of %s failed: %s", merged, err)
+				return
+			}
+			cleanup.Batch.Wait()
+			if err := cleanup.Err; err != nil {
+				log.Warnf("pfcount cleanup of %s failed: %s", merged, err)
+			}
+		}()
+
+		for i, x := range dumps {
+			x.Batch.Wait()
+			if err := x.Err; err != nil {
+				return err
+			}
+			if x.Resp == nil || !x.Resp.IsBulkBytes() || len(x.Resp.Value) == 0 {
+				continue
+			}
+			member := fmt.Sprintf("%s:%d", merged, i)
+			rr := s.alloc.SubRequest(r)
+			rr.Multi = []*redis.Resp{
+				redis.NewString([]byte("RESTORE")),
+				redis.NewString([]byte(member)),
+				redis.NewString([]byte("0")),
+				x.Resp,
+				redis.NewString([]byte("REPLACE")),
+			}
+			if err := d.dispatch(rr); err != nil {
+				return err
+			}
+			rr.Batch.Wait()
+			if err := rr.Err; err != nil {
+				return err
+			}
+			members = append(members, member)
+		}
+
+		merge := s.alloc.SubRequest(r)
+		mergeMulti := []*redis.Resp{
+			redis.NewString([]byte("PFMERGE")),
+			redis.NewString([]byte(merged)),
+		}
+		for _, member := range members {
+			mergeMulti = append(mergeMulti, redis.NewString([]byte(member)))
+		}
+		merge.Multi = mergeMulti
+		if err := d.dispatch(merge); err != nil {
+			return err
+		}
+		merge.Batch.Wait()
+		if err := merge.Err; err != nil {
+			return err
+		}
+
+		count := s.alloc.SubRequest(r)
+		count.Multi = []*redis.Resp{
+			redis.NewString([]byte("PFCOUNT")),
+			redis.NewString([]byte(merged)),
+		}
+		if err := d.dispatch(count); err != nil {
+			return err
+		}
+		count.Batch.Wait()
+		if err := count.Err; err != nil {
+			return err
+		}
+		r.Resp = count.Resp
+		return nil
+	}
+	return nil
+}
@@ -0,0 +1,263 @@
+// Copyright 2016 CodisLabs. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package proxy
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/CodisLabs/codis/pkg/proxy/redis"
+	"github.com/CodisLabs/codis/pkg/utils/log"
+)
+
+// pubsubState tracks a session that has moved into pub/sub mode. Once the
+// first (P)SUBSCRIBE arrives, the session stops expecting a single reply per
+// Request; messages are pumped to the client out-of-band by a dedicated
+// writer goroutine instead of through the normal tasks channel.
+type pubsubState struct {
+	active bool
+	mu     sync.Mutex
+	conns  map[string]*redis.Conn // backend group addr -> dedicated conn
+	quit   chan struct{}
+}
+
+func (s *Session) enterPubSub(d *Router) error {
+	s.pubsub.mu.Lock()
+	defer s.pubsub.mu.Unlock()
+	if s.pubsub.active {
+		return nil
+	}
+	s.pubsub.conns = make(map[string]*redis.Conn)
+	s.pubsub.quit = make(chan struct{})
+	s.pubsub.active = true
+
+	for _, addr := range d.BackendAddrs() {
+		conn, err := d.dispatchGroupConn(addr)
+		if err != nil {
+			continue
+		}
+		s.pubsub.conns[addr] = conn
+		go s.loopPubSubReader(addr, conn, s.pubsub.quit)
+	}
+	return nil
+}
+
+// pubsubConns returns a snapshot of the current per-group connections, safe
+// to iterate without holding pubsub.mu for the (potentially slow) network
+// writes that follow.
+func (s *Session) pubsubConns() []*redis.Conn {
+	s.pubsub.mu.Lock()
+	defer s.pubsub.mu.Unlock()
+	conns := make([]*redis.Conn, 0, len(s.pubsub.conns))
+	for _, conn := range s.pubsub.conns {
+		conns = append(conns, conn)
+	}
+	return conns
+}
+
+// pubsubActive reports whether this session has entered pub/sub mode, i.e.
+// has handled a (P)SUBSCRIBE and has not been closed since; unsubscribing
+// from every channel does not clear it. Safe to call from another session's
+// goroutine, used by CLIENT TRACKING REDIRECT to validate a RESP2 redirect
+// target.
+func (s *Session) pubsubActive() bool {
+	s.pubsub.mu.Lock()
+	defer s.pubsub.mu.Unlock()
+	return s.pubsub.active
+}
+
+// loopPubSubReader pumps push messages received on a dedicated backend
+// connection straight to the client, bypassing the Request/tasks pipeline
+// entirely. quit is passed in rather than read off s.pubsub on every
+// iteration, since a later exitPubSub/enterPubSub pair can replace that
+// field concurrently with this goroutine's reads of it.
+func (s *Session) loopPubSubReader(addr string, conn *redis.Conn, quit chan struct{}) {
+	defer conn.Close()
+	for {
+		select {
+		case <-quit:
+			return
+		default:
+		}
+		resp, err := conn.Decode()
+		if err != nil {
+			log.Infof("session [%p] pubsub conn to %s closed: %s", s, addr, err)
+			return
+		}
+		s.writeMu.Lock()
+		err = s.Conn.Encode(resp, true)
+		s.writeMu.Unlock()
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (s *Session) exitPubSub() {
+	s.pubsub.mu.Lock()
+	defer s.pubsub.mu.Unlock()
+	if !s.pubsub.active {
+		return
+	}
+	close(s.pubsub.quit)
+	for _, conn := range s.pubsub.conns {
+		conn.Close()
+	}
+	s.pubsub.active = false
+	s.pubsub.conns = nil
+}
+
+func (s *Session) handleRequestSubscribe(r *Request, d *Router) error {
+	if err := s.enterPubSub(d); err != nil {
+		return err
+	}
+	for _, conn := range s.pubsubConns() {
+		if err := conn.Encode(redis.NewMultiBulk(r.Multi), true); err != nil {
+			return err
+		}
+	}
+	// The real (un)subscribe acks are forwarded to the client straight off
+	// the backend connections by loopPubSubReader; this Request must not go
+	// through the normal tasks/handleResponse pipeline a second time.
+	r.Resp = RespNoReply
+	return nil
+}
+
+func (s *Session) handleRequestUnsubscribe(r *Request, d *Router) error {
+	if !s.pubsubActive() {
+		r.Resp = RespOK
+		return nil
+	}
+	for _, conn := range s.pubsubConns() {
+		if err := conn.Encode(redis.NewMultiBulk(r.Multi), true); err != nil {
+			return err
+		}
+	}
+	r.Resp = RespNoReply
+	return nil
+}
+
+func (s *Session) handleRequestPublish(r *Request, d *Router) error {
+	if len(r.Multi) != 3 {
+		r.Resp = redis.NewErrorf("ERR wrong number of arguments for 'PUBLISH' command")
+		return nil
+	}
+	addrs := d.BackendAddrs()
+	var sub = make([]*Request, len(addrs))
+	for i, addr := range addrs {
+		sub[i] = s.alloc.SubRequest(r)
+		sub[i].Multi = r.Multi
+		if !d.dispatchAddr(sub[i], addr) {
+			return fmt.Errorf("backend server '%s' not found", addr)
+		}
+	}
+	r.Coalesce = func() error {
+		var n int64
+		for _, x := range sub {
+			if err := x.Err; err != nil {
+				return err
+			}
+			if x.Resp != nil && x.Resp.IsInt() {
+				if v, err := redis.Btoi64(x.Resp.Value); err == nil {
+					n += v
+				}
+			}
+		}
+		r.Resp = redis.NewInt([]byte(fmt.Sprintf("%d", n)))
+		return nil
+	}
+	return nil
+}
+
+func (s *Session) handleRequestPubSub(r *Request, d *Router) error {
+	if len(r.Multi) < 2 {
+		r.Resp = redis.NewErrorf("ERR wrong number of arguments for 'PUBSUB' command")
+		return nil
+	}
+	switch sub := string(r.Multi[1].Value); sub {
+	case "CHANNELS", "channels":
+		return s.handlePubSubChannels(r, d)
+	case "NUMSUB", "numsub":
+		return s.handlePubSubNumSub(r, d)
+	default:
+		r.Resp = redis.NewErrorf("ERR unknown PUBSUB subcommand '%s'", sub)
+		return nil
+	}
+}
+
+func (s *Session) handlePubSubChannels(r *Request, d *Router) error {
+	addrs := d.BackendAddrs()
+	var sub = make([]*Request, len(addrs))
+	for i, addr := range addrs {
+		sub[i] = s.alloc.SubRequest(r)
+		sub[i].Multi = r.Multi
+		if !d.dispatchAddr(sub[i], addr) {
+			return fmt.Errorf("backend server '%s' not found", addr)
+		}
+	}
+	r.Coalesce = func() error {
+		seen := make(map[string]bool)
+		var array []*redis.Resp
+		for _, x := range sub {
+			if err := x.Err; err != nil {
+				return err
+			}
+			if x.Resp == nil || !x.Resp.IsArray() {
+				continue
+			}
+			for _, ch := range x.Resp.Array {
+				if !seen[string(ch.Value)] {
+					seen[string(ch.Value)] = true
+					array = append(array, ch)
+				}
+			}
+		}
+		r.Resp = redis.NewArray(array)
+		return nil
+	}
+	return nil
+}
+
+func (s *Session) handlePubSubNumSub(r *Request, d *Router) error {
+	addrs := d.BackendAddrs()
+	var sub = make([]*Request, len(addrs))
+	for i, addr := range addrs {
+		sub[i] = s.alloc.SubRequest(r)
+		sub[i].Multi = r.Multi
+		if !d.dispatchAddr(sub[i], addr) {
+			return fmt.Errorf("backend server '%s' not found", addr)
+		}
+	}
+	r.Coalesce = func() error {
+		totals := make(map[string]int64)
+		var order []string
+		for _, x := range sub {
+			if err := x.Err; err != nil {
+				return err
+			}
+			if x.Resp == nil || !x.Resp.IsArray() {
+				continue
+			}
+			for i := 0; i+1 < len(x.Resp.Array); i += 2 {
+				ch := string(x.Resp.Array[i].Value)
+				if _, ok := totals[ch]; !ok {
+					order = append(order, ch)
+				}
+				if v, err := redis.Btoi64(x.Resp.Array[i+1].Value); err == nil {
+					totals[ch] += v
+				}
+			}
+		}
+		var array []*redis.Resp
+		for _, ch := range order {
+			array = append(array,
+				redis.NewString([]byte(ch)),
+				redis.NewInt([]byte(fmt.Sprintf("%d", totals[ch]))),
+			)
+		}
+		r.Resp = redis.NewArray(array)
+		return nil
+	}
+	return nil
+}
@@ -0,0 +1,262 @@
+// Copyright 2016 CodisLabs. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package proxy
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/CodisLabs/codis/pkg/proxy/redis"
+	"github.com/CodisLabs/codis/pkg/utils/log"
+)
+
+var sessionIdGen int64
+
+func nextSessionId() int64 {
+	return atomic.AddInt64(&sessionIdGen, 1)
+}
+
+// sessionsByID looks up a live Session by its CLIENT ID, so CLIENT TRACKING
+// REDIRECT can find the actual client the invalidation messages are meant
+// for instead of only ever pushing to the session that issued the command.
+var sessionsByID sync.Map // int64 -> *Session
+
+// trackingState is a session's CLIENT TRACKING configuration: either BCAST
+// (every key under a set of prefixes) or default (only keys this session
+// has itself read), optionally redirected to another client's push channel.
+type trackingState struct {
+	on       bool
+	bcast    bool
+	redirect int64
+}
+
+func (s *Session) handleRequestClientTracking(r *Request, args []*redis.Resp) error {
+	if len(args) == 0 {
+		r.Resp = redis.NewErrorf("ERR wrong number of arguments for 'CLIENT|TRACKING' command")
+		return nil
+	}
+	switch strings.ToUpper(string(args[0].Value)) {
+	case "OFF":
+		s.stopTracking()
+		r.Resp = RespOK
+		return nil
+	case "ON":
+		// fallthrough to option parsing below
+	default:
+		r.Resp = redis.NewErrorf("ERR syntax error")
+		return nil
+	}
+
+	var bcast bool
+	var redirect int64
+	var prefixes []string
+	for i := 1; i < len(args); i++ {
+		switch opt := strings.ToUpper(string(args[i].Value)); opt {
+		case "BCAST":
+			bcast = true
+		case "REDIRECT":
+			if i+1 >= len(args) {
+				r.Resp = redis.NewErrorf("ERR syntax error")
+				return nil
+			}
+			i++
+			n, err := strconv.ParseInt(string(args[i].Value), 10, 64)
+			if err != nil {
+				r.Resp = redis.NewErrorf("ERR value is not an integer or out of range")
+				return nil
+			}
+			redirect = n
+		case "PREFIX":
+			if i+1 >= len(args) {
+				r.Resp = redis.NewErrorf("ERR syntax error")
+				return nil
+			}
+			i++
+			prefixes = append(prefixes, string(args[i].Value))
+		default:
+			r.Resp = redis.NewErrorf("ERR syntax error")
+			return nil
+		}
+	}
+	if len(prefixes) > 0 && !bcast {
+		r.Resp = redis.NewErrorf("ERR PREFIX option requires BCAST mode to be enabled")
+		return nil
+	}
+	// Real Redis refuses to enable tracking on a RESP2 connection unless the
+	// invalidation messages are being redirected somewhere else (a RESP3
+	// client, or a RESP2 client subscribed to __redis__:invalidate); a bare
+	// RESP2 client has no way to receive a push message itself.
+	if !s.resp3 && redirect == 0 {
+		r.Resp = redis.NewErrorf("ERR Client tracking is only available when RESP3 is used, or through a redirection to a client that uses RESP3, or through a redirection to a Pub/Sub client")
+		return nil
+	}
+
+	if err := s.startTracking(bcast, redirect, prefixes); err != nil {
+		r.Resp = redis.NewErrorf("ERR %s", err)
+		return nil
+	}
+	r.Resp = RespOK
+	return nil
+}
+
+func (s *Session) startTracking(bcast bool, redirect int64, prefixes []string) error {
+	target := s
+	if redirect != 0 {
+		v, ok := sessionsByID.Load(redirect)
+		if !ok {
+			return fmt.Errorf("The client ID you want redirect to does not exist")
+		}
+		target = v.(*Session)
+		// A RESP2 redirect target only makes sense if it's already sitting in
+		// pub/sub mode (subscribed to __redis__:invalidate, same as real
+		// Redis requires); otherwise pushInvalidation's injected `message`
+		// reply would desync that client's normal request/response pairing.
+		if !target.resp3 && !target.pubsubActive() {
+			return fmt.Errorf("The client ID you want redirect to does not use RESP3 protocol, or the Pub/Sub mode was not activated")
+		}
+	}
+	s.stopTracking()
+	s.tracking = trackingState{on: true, bcast: bcast, redirect: redirect}
+	invalidations.Register(target.Id, target.pushInvalidation)
+	if bcast {
+		if len(prefixes) == 0 {
+			prefixes = []string{""}
+		}
+		for _, p := range prefixes {
+			invalidations.TrackPrefix(p, target.Id)
+		}
+	}
+	return nil
+}
+
+func (s *Session) stopTracking() {
+	if !s.tracking.on {
+		return
+	}
+	target := s.Id
+	if s.tracking.redirect != 0 {
+		target = s.tracking.redirect
+	}
+	invalidations.Unregister(target)
+	s.tracking = trackingState{}
+}
+
+// trackRead records that this session fetched key, so a later write to it
+// (by any session) triggers an invalidation push. Only meaningful in
+// default (non-BCAST) mode; BCAST mode tracks by prefix instead. The
+// maxTrackedKeysPerSession cap is enforced by the bus itself against the
+// live (not lifetime) count of outstanding keys.
+func (s *Session) trackRead(key []byte) {
+	if !s.tracking.on || s.tracking.bcast || len(key) == 0 {
+		return
+	}
+	target := s.Id
+	if s.tracking.redirect != 0 {
+		target = s.tracking.redirect
+	}
+	invalidations.TrackKey(string(key), target)
+}
+
+// pushInvalidation is registered with the InvalidationBus under a client id
+// and is called from whichever goroutine published the write; it must not
+// block for long, so a full push channel just drops tracking for this
+// session instead of stalling the writer that triggered the invalidation.
+//
+// It is bound to whichever Session actually owns that client id, which on a
+// REDIRECT is not necessarily the session that ran CLIENT TRACKING: the
+// redirect target is commonly a plain RESP2 connection that SUBSCRIBEd to
+// __redis__:invalidate, so the message has to look like an ordinary pub/sub
+// message rather than a RESP3 push on that connection.
+func (s *Session) pushInvalidation(key string) bool {
+	var msg *redis.Resp
+	if s.resp3 {
+		msg = redis.NewPush([]*redis.Resp{
+			redis.NewString([]byte("invalidate")),
+			redis.NewArray([]*redis.Resp{redis.NewString([]byte(key))}),
+		})
+	} else {
+		msg = redis.NewMultiBulk([]*redis.Resp{
+			redis.NewString([]byte("message")),
+			redis.NewString([]byte("__redis__:invalidate")),
+			redis.NewArray([]*redis.Resp{redis.NewString([]byte(key))}),
+		})
+	}
+	select {
+	case s.pushCh <- msg:
+		return true
+	default:
+		log.Infof("session [%p] tracking push backlog full, disabling CLIENT TRACKING", s)
+		return false
+	}
+}
+
+func (s *Session) loopPush() {
+	for msg := range s.pushCh {
+		s.writeMu.Lock()
+		err := s.Conn.Encode(msg, true)
+		s.writeMu.Unlock()
+		if err != nil {
+			return
+		}
+	}
+}
+
+// writeCommands lists the opstrs that mutate a key and must therefore
+// trigger a CLIENT TRACKING invalidation once they succeed.
+var writeCommands = map[string]bool{
+	"SET": true, "SETNX": true, "SETEX": true, "PSETEX": true, "GETSET": true, "GETDEL": true,
+	"APPEND": true, "MSET": true, "MSETNX": true, "DEL": true, "UNLINK": true, "RENAME": true,
+	"RENAMENX": true, "RESTORE": true, "COPY": true, "EXPIRE": true, "PEXPIRE": true,
+	"EXPIREAT": true, "PEXPIREAT": true, "PERSIST": true,
+	"INCR": true, "INCRBY": true, "INCRBYFLOAT": true, "DECR": true, "DECRBY": true,
+	"HSET": true, "HSETNX": true, "HMSET": true, "HDEL": true, "HINCRBY": true, "HINCRBYFLOAT": true,
+	"LPUSH": true, "RPUSH": true, "LPUSHX": true, "RPUSHX": true, "LPOP": true, "RPOP": true,
+	"LSET": true, "LREM": true, "LTRIM": true, "LINSERT": true,
+	"SADD": true, "SREM": true, "SPOP": true, "SMOVE": true,
+	"ZADD": true, "ZREM": true, "ZINCRBY": true, "ZPOPMIN": true, "ZPOPMAX": true,
+	"PFADD": true, "PFMERGE": true, "SETBIT": true, "BITOP": true, "GETEX": true,
+}
+
+func isWriteCommand(opstr string) bool {
+	return writeCommands[opstr]
+}
+
+func (s *Session) handleRequestClient(r *Request, d *Router) error {
+	if len(r.Multi) < 2 {
+		r.Resp = redis.NewErrorf("ERR wrong number of arguments for 'CLIENT' command")
+		return nil
+	}
+	switch strings.ToUpper(string(r.Multi[1].Value)) {
+	case "TRACKING":
+		return s.handleRequestClientTracking(r, r.Multi[2:])
+	case "ID":
+		r.Resp = redis.NewInt([]byte(strconv.FormatInt(s.Id, 10)))
+	default:
+		r.Resp = RespOK
+	}
+	return nil
+}
+
+func (s *Session) handleRequestHello(r *Request) error {
+	if len(r.Multi) < 2 {
+		r.Resp = redis.NewArray(nil)
+		return nil
+	}
+	ver, err := strconv.Atoi(string(r.Multi[1].Value))
+	if err != nil || (ver != 2 && ver != 3) {
+		r.Resp = redis.NewErrorf("NOPROTO unsupported protocol version")
+		return nil
+	}
+	s.resp3 = ver == 3
+	r.Resp = redis.NewArray([]*redis.Resp{
+		redis.NewString([]byte("server")),
+		redis.NewString([]byte("codis")),
+		redis.NewString([]byte("proto")),
+		redis.NewInt([]byte(strconv.Itoa(ver))),
+	})
+	return nil
+}
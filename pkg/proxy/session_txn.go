@@ -0,0 +1,177 @@
+// Copyright 2016 CodisLabs. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package proxy
+
+import (
+	"github.com/CodisLabs/codis/pkg/proxy/redis"
+)
+
+// txnState tracks an in-flight MULTI/EXEC block on a Session. Codis only
+// supports transactions that stay within a single slot, since the queued
+// commands are replayed on one pinned backend connection.
+type txnState struct {
+	active  bool
+	hasSlot bool
+	slot    int
+	queued  []*Request
+	conn    *redis.Conn
+}
+
+func (s *Session) handleTxnMulti(r *Request) error {
+	// A preceding WATCH may already have pinned a connection (and the slot
+	// it watched on); MULTI must keep using it instead of silently leaking
+	// it and dispatching EXEC on a fresh connection, which would void the
+	// WATCH guarantee.
+	s.txn = txnState{
+		active:  true,
+		hasSlot: s.txn.hasSlot,
+		slot:    s.txn.slot,
+		conn:    s.txn.conn,
+	}
+	r.Resp = RespOK
+	return nil
+}
+
+// txnKeySlot resolves the single slot every key a command carries must hash
+// to, using commandKeys so a multi-key command (MGET k1 k2, WATCH k1 k2, ...)
+// is checked against all of its keys instead of only the first.
+func txnKeySlot(d *Router, multi []*redis.Resp, opstr string) (slot int, hasKey bool, crossSlot bool) {
+	for _, key := range commandKeys(multi, opstr) {
+		if len(key) == 0 {
+			continue
+		}
+		ks := d.KeyToSlot(key)
+		if !hasKey {
+			slot, hasKey = ks, true
+			continue
+		}
+		if ks != slot {
+			return 0, true, true
+		}
+	}
+	return slot, hasKey, false
+}
+
+func (s *Session) handleTxnQueue(r *Request, d *Router) error {
+	slot, hasKey, crossSlot := txnKeySlot(d, r.Multi, r.OpStr)
+	if crossSlot || (hasKey && s.txn.hasSlot && s.txn.slot != slot) {
+		r.Resp = redis.NewErrorf("CROSSSLOT Keys in transaction don't hash to the same slot")
+		// The connection a preceding WATCH may already have checked out from
+		// the pool; handleTxnReset only zeroes the struct,
+		// so it must be closed here first or it's never returned.
+		if conn := s.txn.conn; conn != nil {
+			conn.Close()
+		}
+		s.handleTxnReset()
+		return nil
+	}
+	if hasKey && !s.txn.hasSlot {
+		s.txn.hasSlot = true
+		s.txn.slot = slot
+	}
+	s.txn.queued = append(s.txn.queued, r)
+	r.Resp = redis.NewString([]byte("QUEUED"))
+	return nil
+}
+
+func (s *Session) handleTxnExec(r *Request, d *Router) error {
+	queued := s.txn.queued
+	if !s.txn.hasSlot {
+		s.handleTxnReset()
+		r.Resp = redis.NewArray(nil)
+		return nil
+	}
+	conn := s.txn.conn
+	if conn == nil {
+		var err error
+		conn, err = d.dispatchTxn(s.txn.slot)
+		if err != nil {
+			s.handleTxnReset()
+			return err
+		}
+	}
+	defer func() {
+		conn.Close()
+		s.handleTxnReset()
+	}()
+
+	if err := conn.Encode(redis.NewMultiBulk([]*redis.Resp{redis.NewString([]byte("MULTI"))}), false); err != nil {
+		return err
+	}
+	for _, sub := range queued {
+		if err := conn.Encode(redis.NewMultiBulk(sub.Multi), false); err != nil {
+			return err
+		}
+	}
+	if err := conn.Encode(redis.NewMultiBulk([]*redis.Resp{redis.NewString([]byte("EXEC"))}), true); err != nil {
+		return err
+	}
+
+	// Drain the MULTI ack plus one QUEUED ack per queued command; the real
+	// results all arrive together as the single array reply to EXEC.
+	for i := 0; i < len(queued)+1; i++ {
+		if _, err := conn.Decode(); err != nil {
+			return err
+		}
+	}
+	resp, err := conn.Decode()
+	if err != nil {
+		return err
+	}
+	r.Resp = redis.NewArray(resp.Array)
+	return nil
+}
+
+func (s *Session) handleTxnDiscard(r *Request) error {
+	if conn := s.txn.conn; conn != nil {
+		conn.Close()
+	}
+	s.handleTxnReset()
+	r.Resp = RespOK
+	return nil
+}
+
+func (s *Session) handleTxnWatch(r *Request, d *Router) error {
+	if len(r.Multi) < 2 {
+		r.Resp = redis.NewErrorf("ERR wrong number of arguments for 'WATCH' command")
+		return nil
+	}
+	if s.txn.conn == nil {
+		slot, hasKey, crossSlot := txnKeySlot(d, r.Multi, r.OpStr)
+		if crossSlot || (hasKey && s.txn.hasSlot && s.txn.slot != slot) {
+			r.Resp = redis.NewErrorf("CROSSSLOT Keys in transaction don't hash to the same slot")
+			return nil
+		}
+		conn, err := d.dispatchTxn(slot)
+		if err != nil {
+			return err
+		}
+		s.txn.hasSlot = true
+		s.txn.slot = slot
+		s.txn.conn = conn
+	}
+	if err := s.txn.conn.Encode(redis.NewMultiBulk(r.Multi), true); err != nil {
+		return err
+	}
+	resp, err := s.txn.conn.Decode()
+	if err != nil {
+		return err
+	}
+	r.Resp = resp
+	return nil
+}
+
+func (s *Session) handleTxnUnwatch(r *Request) error {
+	if conn := s.txn.conn; conn != nil && !s.txn.active {
+		conn.Close()
+		s.txn.conn = nil
+		s.txn.hasSlot = false
+	}
+	r.Resp = RespOK
+	return nil
+}
+
+func (s *Session) handleTxnReset() {
+	s.txn = txnState{}
+}